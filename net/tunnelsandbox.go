@@ -0,0 +1,182 @@
+package netconn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TunnelRule describes one entry of the sandbox's target policy, matched in
+// order against the RemoteHost:RemotePort an attacker asks direct-tcpip to
+// reach.
+type TunnelRule struct {
+	CIDR     string // e.g. "10.0.0.0/8", empty means "any"
+	Port     int    // 0 means "any port"
+	HostRegx string // matched against RemoteHost when CIDR doesn't apply
+	Action   string // "allow", "deny", "sandbox"
+}
+
+// TunnelSandbox decides what happens when an attacker asks a honeypot
+// session to open a direct-tcpip channel, and for targets it doesn't want to
+// actually dial, hands the channel to a protocol-aware responder instead of
+// either blindly connecting (open-proxy risk) or dropping the connection
+// (an obvious tell).
+type TunnelSandbox struct {
+	rules     []TunnelRule
+	responder func(port int) Responder
+}
+
+// Responder speaks just enough of a protocol to look real to an automated
+// probe, while recording whatever the attacker sends.
+type Responder func(conn io.ReadWriter, log *log.Entry)
+
+// NewTunnelSandbox builds a sandbox from the given rule set. Rules are
+// evaluated in order and the first match wins; if nothing matches, the
+// target is rejected.
+func NewTunnelSandbox(rules []TunnelRule) *TunnelSandbox {
+	return &TunnelSandbox{
+		rules:     rules,
+		responder: defaultResponderFor,
+	}
+}
+
+// Decision is the outcome of resolving a direct-tcpip target.
+type Decision int
+
+const (
+	// DecisionReject means the channel should be rejected outright.
+	DecisionReject Decision = iota
+	// DecisionAllow means the caller may dial RemoteHost:RemotePort directly.
+	DecisionAllow
+	// DecisionSandbox means the caller should accept the channel and hand it
+	// to the Responder returned alongside this decision.
+	DecisionSandbox
+)
+
+// Resolve matches host/port against the rule set and returns what the
+// caller should do with the channel.
+func (t *TunnelSandbox) Resolve(remoteHost string, remotePort uint32) (Decision, Responder) {
+	for _, r := range t.rules {
+		if !ruleMatches(r, remoteHost, int(remotePort)) {
+			continue
+		}
+		switch r.Action {
+		case "allow":
+			return DecisionAllow, nil
+		case "sandbox":
+			return DecisionSandbox, t.responder(int(remotePort))
+		default:
+			return DecisionReject, nil
+		}
+	}
+	return DecisionReject, nil
+}
+
+func ruleMatches(r TunnelRule, host string, port int) bool {
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	if r.CIDR != "" {
+		_, ipNet, err := net.ParseCIDR(r.CIDR)
+		if err != nil {
+			return false
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || !ipNet.Contains(ip) {
+			return false
+		}
+		return true
+	}
+	if r.HostRegx != "" {
+		matched, err := regexp.MatchString(r.HostRegx, host)
+		return err == nil && matched
+	}
+	return true
+}
+
+// defaultResponderFor picks a plausible fake banner based on the well-known
+// port the attacker was trying to reach.
+func defaultResponderFor(port int) Responder {
+	switch port {
+	case 80, 8080:
+		return respondHTTP
+	case 25, 587:
+		return respondSMTP
+	case 6379:
+		return respondRedis
+	case 3306:
+		return respondMySQL
+	default:
+		return respondGeneric
+	}
+}
+
+func logPayload(l *log.Entry, proto string, buf []byte, n int) {
+	if n <= 0 {
+		return
+	}
+	l.WithFields(log.Fields{
+		"protocol": proto,
+		"payload":  string(buf[:n]),
+		"bytes":    n,
+	}).Info("Captured payload on sandboxed tunnel")
+}
+
+func respondHTTP(conn io.ReadWriter, l *log.Entry) {
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	logPayload(l, "http", buf, n)
+	body := "<html><body><h1>It works!</h1></body></html>"
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nServer: Apache/2.4.41\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+}
+
+func respondSMTP(conn io.ReadWriter, l *log.Entry) {
+	fmt.Fprint(conn, "220 mail.local ESMTP Postfix\r\n")
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	logPayload(l, "smtp", buf, n)
+	fmt.Fprint(conn, "502 Command not implemented\r\n")
+}
+
+func respondRedis(conn io.ReadWriter, l *log.Entry) {
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	logPayload(l, "redis", buf, n)
+	fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+}
+
+func respondMySQL(conn io.ReadWriter, l *log.Entry) {
+	// Minimal handshake greeting so the client believes it found a real server.
+	greeting := []byte{0x0a}
+	greeting = append(greeting, []byte("5.7.30-log")...)
+	greeting = append(greeting, 0x00)
+	conn.Write(greeting)
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	logPayload(l, "mysql", buf, n)
+}
+
+func respondGeneric(conn io.ReadWriter, l *log.Entry) {
+	buf := make([]byte, 4096)
+	n, _ := conn.Read(buf)
+	logPayload(l, "generic", buf, n)
+}
+
+// ServeResponder runs resp against an already-open channel, bounding how
+// long a stalled attacker connection can hold the goroutine open.
+func ServeResponder(conn io.ReadWriter, resp Responder, l *log.Entry) {
+	done := make(chan struct{})
+	go func() {
+		resp(conn, l)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		l.Warn("Sandboxed tunnel responder timed out")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	realos "os"
 	pathlib "path"
 	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
@@ -21,6 +22,8 @@ type Shell struct {
 	termSignal chan<- int
 	terminal   *terminal.Terminal
 	sys        *System
+	homeDir    string
+	lastCwd    string
 }
 
 func NewShell(iostream io.ReadWriter, fsys afero.Fs, width, height int, user, ipSrc string, log *log.Entry, termSignal chan<- int) *Shell {
@@ -40,6 +43,7 @@ func NewShell(iostream io.ReadWriter, fsys afero.Fs, width, height int, user, ip
 		log:        log,
 		termSignal: termSignal,
 		sys:        sys,
+		homeDir:    usernameMapping[user].Homedir,
 	}
 }
 
@@ -72,25 +76,9 @@ cmdLoop:
 			sh.log.Infof("User logged out")
 			sh.termSignal <- 0
 			return
-		case strings.HasPrefix(cmd, "cd"):
-			args := strings.Split(cmd, " ")
-			if len(args) > 1 {
-				err := sh.sys.Chdir(args[1])
-				if err != nil {
-					sh.terminal.Write([]byte(fmt.Sprintf("-bash: cd: %v: No such file or directory\n", args[1])))
-				}
-			}
-		case strings.HasPrefix(cmd, "export"):
-
 		default:
-			// Start parsing script
-
-			args := strings.SplitN(cmd, " ", 2)
-			n, err := sh.Exec(args[0], args[1:])
-			if err != nil {
-				sh.terminal.Write([]byte(fmt.Sprintf("%v: command not found\n", args[0])))
-			} else {
-				sh.sys.envVars["?"] = string(n)
+			if err := sh.runLine(cmd); err != nil {
+				sh.terminal.Write([]byte(fmt.Sprintf("-bash: %v\n", err)))
 			}
 		}
 	}
@@ -108,12 +96,18 @@ func (sh *Shell) input(line string) error {
 }
 
 func (sh *Shell) Exec(path string, args []string) (int, error) {
+	return execOn(sh.sys, path, args)
+}
+
+// execOn runs a registered command against an arbitrary System, which lets
+// runLine give each pipeline stage its own stdin/stdout without touching
+// the session's real terminal stream.
+func execOn(sys *System, path string, args []string) (int, error) {
 	cmd := pathlib.Base(path)
 	if execFunc, ok := funcMap[cmd]; ok {
-		res := execFunc.Exec(args, sh.sys)
+		res := execFunc.Exec(args, sys)
 		return res, nil
 	}
-
 	return -1, realos.ErrNotExist
 }
 
@@ -123,6 +117,229 @@ func (sh *Shell) SetSize(width, height int) error {
 	return sh.terminal.SetSize(width, height)
 }
 
+// changeDir implements "cd", including the "cd -" (go to the previous
+// working directory, tracked in lastCwd rather than an OLDPWD variable) and
+// "cd ~" (go to home) forms bash supports. args are the already
+// tokenized (quote-stripped, $VAR-expanded) words following "cd"; it
+// returns the shell exit code for the builtin.
+func (sh *Shell) changeDir(args []string) int {
+	prev := sh.sys.cwd
+	target := strings.Join(args, " ")
+	switch {
+	case target == "":
+		target = sh.homeDir
+	case target == "-":
+		if sh.lastCwd == "" {
+			sh.terminal.Write([]byte("-bash: cd: OLDPWD not set\n"))
+			return 1
+		}
+		target = sh.lastCwd
+	case target == "~" || strings.HasPrefix(target, "~/"):
+		target = expandTilde(target, sh.homeDir)
+	}
+	if err := sh.sys.Chdir(target); err != nil {
+		sh.terminal.Write([]byte(fmt.Sprintf("-bash: cd: %v: No such file or directory\n", target)))
+		return 1
+	}
+	sh.lastCwd = prev
+	return 0
+}
+
+// export implements the shell builtin: "export NAME=VALUE" sets the
+// variable for each word given, bare "export NAME" is a no-op since every
+// var we track already behaves as exported. args are the already
+// tokenized (quote-stripped, $VAR-expanded) words following "export"; it
+// returns the shell exit code for the builtin.
+func (sh *Shell) export(args []string) int {
+	for _, arg := range args {
+		if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+			sh.sys.envVars[parts[0]] = parts[1]
+		}
+	}
+	return 0
+}
+
+// runLine tokenizes, parses and executes one command line, wiring up
+// pipes, sequencing and redirection against the session's virtual
+// filesystem.
+func (sh *Shell) runLine(line string) error {
+	stmts, err := parseLine(line, sh.sys.envVars, sh.homeDir)
+	if err != nil {
+		return err
+	}
+	lastOk := true
+	prevJoin := sepNone
+	for _, st := range stmts {
+		// Whether this statement runs depends on how the previous one was
+		// joined to it, not on its own joinNext.
+		join := prevJoin
+		prevJoin = st.joinNext
+		switch join {
+		case sepAnd:
+			if !lastOk {
+				continue
+			}
+		case sepOr:
+			if lastOk {
+				continue
+			}
+		}
+		code, err := sh.runStatement(st.pipeline)
+		lastOk = err == nil && code == 0
+		sh.sys.envVars["?"] = fmt.Sprintf("%d", code)
+	}
+	return nil
+}
+
+// runStatement runs one pipeline out of a statement list. cd/export are
+// shell builtins that mutate the session's persistent state (cwd, env)
+// rather than an external command's own System copy, so a lone cd/export
+// pipeline stage is dispatched straight to them instead of going through
+// runPipeline/execOn - this is what lets "cd /tmp && whoami" and
+// "foo; export BAR=1" sequence correctly, and what makes cd/export work
+// at all once they're not the first word of the raw line.
+func (sh *Shell) runStatement(p pipelineNode) (int, error) {
+	if len(p.cmds) == 1 {
+		switch p.cmds[0].name {
+		case "cd":
+			return sh.changeDir(p.cmds[0].args), nil
+		case "export":
+			return sh.export(p.cmds[0].args), nil
+		}
+	}
+	return sh.runPipeline(p)
+}
+
+// runPipeline runs every stage of a pipeline, chaining stdout to stdin via
+// io.Pipe so registered commands like cat/grep/wc can actually feed each
+// other, and returns the exit code of the last stage.
+func (sh *Shell) runPipeline(p pipelineNode) (int, error) {
+	run := func() (int, error) {
+		n := len(p.cmds)
+		// One io.Pipe between each adjacent pair of stages so registered
+		// commands like cat/grep/wc can actually feed each other.
+		stageIn := make([]io.Reader, n)
+		stageOut := make([]io.Writer, n)
+		stageIn[0] = sh.sys.io
+		stageOut[n-1] = sh.sys.io
+		for i := 0; i < n-1; i++ {
+			pr, pw := io.Pipe()
+			stageOut[i] = pw
+			stageIn[i+1] = pr
+		}
+
+		var lastCode int
+		var lastErr error
+		var wg sync.WaitGroup
+		for i, node := range p.cmds {
+			origIn, origOut := stageIn[i], stageOut[i]
+			in, out, closeFn, err := sh.applyRedirects(node, origIn, origOut)
+			if err != nil {
+				return -1, err
+			}
+			// A redirect may have overridden the pipe end this stage would
+			// otherwise share with its pipeline neighbour. Close the
+			// orphaned end right away so that neighbour isn't left
+			// blocked forever waiting on data/drainage that will never
+			// come (e.g. "echo hi > /tmp/x | cat" must still let cat see
+			// EOF immediately).
+			if out != origOut {
+				if pw, ok := origOut.(*io.PipeWriter); ok {
+					pw.Close()
+				}
+			}
+			if in != origIn {
+				if pr, ok := origIn.(*io.PipeReader); ok {
+					pr.CloseWithError(io.ErrClosedPipe)
+				}
+			}
+			stageSys := *sh.sys
+			stageSys.io = ioReadWriter{in, out}
+
+			wg.Add(1)
+			go func(node cmdNode, isLast bool, out io.Writer, closeFn func()) {
+				defer wg.Done()
+				defer closeFn()
+				if pw, ok := out.(*io.PipeWriter); ok {
+					defer pw.Close()
+				}
+				code, err := execOn(&stageSys, node.name, node.args)
+				if isLast {
+					lastCode, lastErr = code, err
+				}
+				if err != nil {
+					fmt.Fprintf(out, "%v: command not found\r\n", node.name)
+				}
+			}(node, i == n-1, out, closeFn)
+		}
+		wg.Wait()
+		return lastCode, lastErr
+	}
+	if p.background {
+		go run()
+		return 0, nil
+	}
+	return run()
+}
+
+// ioReadWriter glues a distinct reader and writer into the io.ReadWriter
+// System.io expects.
+type ioReadWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// applyRedirects opens any '>','>>','<' targets a command names against the
+// virtual filesystem, falling back to the pipeline's stdin/stdout, and
+// returns a cleanup func to close whatever files it opened.
+func (sh *Shell) applyRedirects(node cmdNode, stdin io.Reader, stdout io.Writer) (io.Reader, io.Writer, func(), error) {
+	var closers []io.Closer
+	closeFn := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	aferoFs := afero.Afero{Fs: sh.sys.FSys}
+	resolve := func(p string) string {
+		if pathlib.IsAbs(p) {
+			return p
+		}
+		return pathlib.Join(sh.sys.cwd, p)
+	}
+	for _, r := range node.redirects {
+		switch r.kind {
+		case tokRedirOut:
+			f, err := aferoFs.Create(resolve(r.target))
+			if err != nil {
+				closeFn()
+				return nil, nil, func() {}, err
+			}
+			closers = append(closers, f)
+			stdout = f
+		case tokRedirAppend:
+			f, err := aferoFs.OpenFile(resolve(r.target), realos.O_APPEND|realos.O_CREATE|realos.O_WRONLY, 0644)
+			if err != nil {
+				closeFn()
+				return nil, nil, func() {}, err
+			}
+			closers = append(closers, f)
+			stdout = f
+		case tokRedirIn:
+			f, err := sh.sys.FSys.Open(resolve(r.target))
+			if err != nil {
+				closeFn()
+				return nil, nil, func() {}, err
+			}
+			closers = append(closers, f)
+			stdin = f
+		case tokRedirErr, tokRedirErrToOut:
+			// This honeypot shell has no distinct stderr stream yet, so
+			// both just fold into stdout.
+		}
+	}
+	return stdin, stdout, closeFn, nil
+}
+
 // RegisterCommand puts the command implementation into map so
 // it can be invoked from command line
 func RegisterCommand(name string, cmd Command) {
@@ -0,0 +1,299 @@
+package os
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tokKind classifies one lexical token produced by tokenize.
+type tokKind int
+
+const (
+	tokWord tokKind = iota
+	tokPipe
+	tokSemi
+	tokAnd
+	tokOr
+	tokBackground
+	tokRedirOut      // >
+	tokRedirAppend   // >>
+	tokRedirIn       // <
+	tokRedirErr      // 2>
+	tokRedirErrToOut // 2>&1
+)
+
+type token struct {
+	kind tokKind
+	text string
+}
+
+// tokenize splits a command line into tokens the way a POSIX-ish shell
+// would: single/double quoting and backslash escapes suppress word
+// splitting and operator recognition, $VAR and ${VAR} are expanded against
+// env, and a leading ~ in a word is expanded against homeDir.
+func tokenize(line string, env map[string]string, homeDir string) ([]token, error) {
+	var toks []token
+	var cur strings.Builder
+	hasWord := false
+	// quotedStart tracks whether the first character of the current word
+	// came from inside quotes or a backslash escape, in which case a
+	// leading ~ is a literal character and must not be tilde-expanded.
+	quotedStart := false
+
+	flush := func() {
+		if hasWord {
+			word := cur.String()
+			if !quotedStart {
+				word = expandTilde(word, homeDir)
+			}
+			toks = append(toks, token{tokWord, word})
+			cur.Reset()
+			hasWord = false
+			quotedStart = false
+		}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\'':
+			if cur.Len() == 0 {
+				quotedStart = true
+			}
+			hasWord = true
+			j := i + 1
+			for j < len(runes) && runes[j] != '\'' {
+				cur.WriteRune(runes[j])
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			i = j
+		case c == '"':
+			if cur.Len() == 0 {
+				quotedStart = true
+			}
+			hasWord = true
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				if runes[j] == '\\' && j+1 < len(runes) && (runes[j+1] == '"' || runes[j+1] == '\\' || runes[j+1] == '$') {
+					cur.WriteRune(runes[j+1])
+					j += 2
+					continue
+				}
+				if runes[j] == '$' {
+					name, adv := readVarName(runes[j+1:])
+					cur.WriteString(env[name])
+					j += 1 + adv
+					continue
+				}
+				cur.WriteRune(runes[j])
+				j++
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			i = j
+		case c == '\\':
+			if cur.Len() == 0 {
+				quotedStart = true
+			}
+			hasWord = true
+			if i+1 < len(runes) {
+				cur.WriteRune(runes[i+1])
+				i++
+			}
+		case c == '$':
+			hasWord = true
+			name, adv := readVarName(runes[i+1:])
+			cur.WriteString(env[name])
+			i += adv
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '|' && i+1 < len(runes) && runes[i+1] == '|':
+			flush()
+			toks = append(toks, token{tokOr, "||"})
+			i++
+		case c == '|':
+			flush()
+			toks = append(toks, token{tokPipe, "|"})
+		case c == '&' && i+1 < len(runes) && runes[i+1] == '&':
+			flush()
+			toks = append(toks, token{tokAnd, "&&"})
+			i++
+		case c == '&':
+			flush()
+			toks = append(toks, token{tokBackground, "&"})
+		case c == ';':
+			flush()
+			toks = append(toks, token{tokSemi, ";"})
+		case c == '>' && i+1 < len(runes) && runes[i+1] == '>':
+			flush()
+			toks = append(toks, token{tokRedirAppend, ">>"})
+			i++
+		case c == '>':
+			flush()
+			toks = append(toks, token{tokRedirOut, ">"})
+		case c == '<':
+			flush()
+			toks = append(toks, token{tokRedirIn, "<"})
+		case c == '2' && i+1 < len(runes) && runes[i+1] == '>':
+			if i+3 < len(runes) && runes[i+2] == '&' && runes[i+3] == '1' {
+				flush()
+				toks = append(toks, token{tokRedirErrToOut, "2>&1"})
+				i += 3
+			} else {
+				flush()
+				toks = append(toks, token{tokRedirErr, "2>"})
+				i++
+			}
+		default:
+			hasWord = true
+			cur.WriteRune(c)
+		}
+	}
+	flush()
+	return toks, nil
+}
+
+// readVarName reads a $NAME or ${NAME} reference starting right after the
+// '$', returning the variable name and how many runes to advance past it.
+func readVarName(rest []rune) (string, int) {
+	if len(rest) == 0 {
+		return "", 0
+	}
+	if rest[0] == '{' {
+		for i := 1; i < len(rest); i++ {
+			if rest[i] == '}' {
+				return string(rest[1:i]), i + 1
+			}
+		}
+		return "", 0
+	}
+	i := 0
+	for i < len(rest) && (isAlnum(rest[i]) || rest[i] == '_') {
+		i++
+	}
+	return string(rest[:i]), i
+}
+
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func expandTilde(word, homeDir string) string {
+	if word == "~" {
+		return homeDir
+	}
+	if strings.HasPrefix(word, "~/") {
+		return homeDir + word[1:]
+	}
+	return word
+}
+
+// redirect describes one IO redirection attached to a command.
+type redirect struct {
+	kind   tokKind
+	target string
+}
+
+// cmdNode is a single command with its arguments and redirections, one
+// stage of a pipeline.
+type cmdNode struct {
+	name      string
+	args      []string
+	redirects []redirect
+}
+
+// pipelineNode is one or more cmdNodes chained with '|'.
+type pipelineNode struct {
+	cmds       []cmdNode
+	background bool
+}
+
+// sep records how a pipeline is joined to the next one in a statement list.
+type sep int
+
+const (
+	sepNone sep = iota
+	sepSeq      // ;
+	sepAnd      // &&
+	sepOr       // ||
+)
+
+type stmt struct {
+	pipeline pipelineNode
+	joinNext sep
+}
+
+// parseLine tokenizes and parses a full command line into the statement
+// list that runLine executes.
+func parseLine(line string, env map[string]string, homeDir string) ([]stmt, error) {
+	toks, err := tokenize(line, env, homeDir)
+	if err != nil {
+		return nil, err
+	}
+	var stmts []stmt
+	var pipe pipelineNode
+	var cmd cmdNode
+	flushCmd := func() {
+		if cmd.name != "" || len(cmd.args) > 0 || len(cmd.redirects) > 0 {
+			pipe.cmds = append(pipe.cmds, cmd)
+			cmd = cmdNode{}
+		}
+	}
+	flushPipe := func(join sep) error {
+		flushCmd()
+		if len(pipe.cmds) == 0 {
+			return fmt.Errorf("syntax error: empty command")
+		}
+		stmts = append(stmts, stmt{pipeline: pipe, joinNext: join})
+		pipe = pipelineNode{}
+		return nil
+	}
+
+	for i := 0; i < len(toks); i++ {
+		t := toks[i]
+		switch t.kind {
+		case tokWord:
+			if cmd.name == "" {
+				cmd.name = t.text
+			} else {
+				cmd.args = append(cmd.args, t.text)
+			}
+		case tokPipe:
+			flushCmd()
+		case tokBackground:
+			pipe.background = true
+			if err := flushPipe(sepNone); err != nil {
+				return nil, err
+			}
+		case tokSemi:
+			if err := flushPipe(sepSeq); err != nil {
+				return nil, err
+			}
+		case tokAnd:
+			if err := flushPipe(sepAnd); err != nil {
+				return nil, err
+			}
+		case tokOr:
+			if err := flushPipe(sepOr); err != nil {
+				return nil, err
+			}
+		case tokRedirOut, tokRedirAppend, tokRedirIn, tokRedirErr, tokRedirErrToOut:
+			if i+1 >= len(toks) || toks[i+1].kind != tokWord {
+				return nil, fmt.Errorf("syntax error near %q", t.text)
+			}
+			cmd.redirects = append(cmd.redirects, redirect{kind: t.kind, target: toks[i+1].text})
+			i++
+		}
+	}
+	if cmd.name != "" || len(cmd.args) > 0 || len(cmd.redirects) > 0 || len(pipe.cmds) > 0 {
+		if err := flushPipe(sepNone); err != nil {
+			return nil, err
+		}
+	}
+	return stmts, nil
+}
@@ -12,6 +12,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
@@ -38,10 +39,17 @@ type SSHSession struct {
 	src           net.Addr
 	clientVersion string
 	sshChan       <-chan ssh.NewChannel
+	conn          *ssh.ServerConn
 	log           *log.Entry
 	sys           *os.System
 	term          string
 	fs            afero.Fs
+	pubKey        ssh.PublicKey
+	agentFwdMu    sync.Mutex
+	agentFwd      bool
+	sandbox       *netconn.TunnelSandbox
+	sinksMu       sync.Mutex
+	sinks         map[string]net.Listener
 }
 
 type envRequest struct {
@@ -69,6 +77,23 @@ type tunnelRequest struct {
 	LocalPort  uint32
 }
 
+// tcpipForwardRequest is the payload of a global "tcpip-forward" or
+// "cancel-tcpip-forward" request, RFC 4254 §7.1.
+type tcpipForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// forwardedTCPPayload is the payload of a "forwarded-tcpip" channel open,
+// RFC 4254 §7.2, which we send to the attacker whenever a sinked reverse
+// port-forward's fake listener accepts a connection.
+type forwardedTCPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
 type Server struct {
 	sshCfg *ssh.ServerConfig
 	vfs    afero.Fs
@@ -94,15 +119,233 @@ func NewSSHSession(nConn net.Conn, sshConfig *ssh.ServerConfig, vfs afero.Fs) (*
 	})
 	logger.Infof("New SSH connection with client")
 
-	go ssh.DiscardRequests(reqs)
-	return &SSHSession{
+	sess := &SSHSession{
 		user:          conn.User(),
 		src:           conn.RemoteAddr(),
 		clientVersion: string(conn.ClientVersion()),
 		sshChan:       chans,
+		conn:          conn,
 		log:           logger,
 		fs:            vfs,
-	}, nil
+		sandbox:       netconn.NewTunnelSandbox(loadTunnelRules()),
+		sinks:         make(map[string]net.Listener),
+	}
+	if conn.Permissions != nil {
+		if blob, ok := conn.Permissions.Extensions[pubKeyExtKey]; ok {
+			if raw, err := base64.StdEncoding.DecodeString(blob); err == nil {
+				if key, err := ssh.ParsePublicKey(raw); err == nil {
+					sess.pubKey = key
+				}
+			}
+		}
+	}
+	go sess.handleGlobalRequests(reqs)
+	return sess, nil
+}
+
+// loadTunnelRules reads server.tunnelSandbox.rules from the config into the
+// rule set the netconn.TunnelSandbox uses to decide what to do with a
+// direct-tcpip target.
+func loadTunnelRules() []netconn.TunnelRule {
+	var rules []netconn.TunnelRule
+	if err := viper.UnmarshalKey("server.tunnelSandbox.rules", &rules); err != nil {
+		log.WithError(err).Warn("Cannot parse server.tunnelSandbox.rules, tunnels will be rejected")
+	}
+	return rules
+}
+
+// handleGlobalRequests answers connection-wide requests. The only ones we
+// care about are the reverse port-forward pair; everything else is
+// discarded as before.
+func (s *SSHSession) handleGlobalRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(req)
+		case "cancel-tcpip-forward":
+			s.handleCancelTCPIPForward(req)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *SSHSession) handleTCPIPForward(req *ssh.Request) {
+	var fwdReq tcpipForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &fwdReq); err != nil {
+		s.log.WithError(err).Error("Cannot parse tcpip-forward request")
+		req.Reply(false, nil)
+		return
+	}
+	policy := viper.GetString("server.reverseForward")
+	logger := s.log.WithFields(log.Fields{
+		"bindAddr": fwdReq.BindAddr,
+		"bindPort": fwdReq.BindPort,
+		"policy":   policy,
+	})
+	if policy == "disable" || policy == "" {
+		logger.Info("Rejected reverse port-forward request")
+		req.Reply(false, nil)
+		return
+	}
+	port := fwdReq.BindPort
+	if port == 0 {
+		port = uint32(30000 + rand.Intn(20000))
+	}
+	if policy == "sink" {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.WithError(err).Error("Cannot start sink listener for reverse port-forward")
+			req.Reply(false, nil)
+			return
+		}
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok {
+			port = uint32(tcpAddr.Port)
+		}
+		s.sinksMu.Lock()
+		s.sinks[reverseForwardKey(fwdReq.BindAddr, fwdReq.BindPort)] = listener
+		s.sinksMu.Unlock()
+		go s.serveSink(listener, fwdReq, logger)
+	}
+	logger.WithField("allocatedPort", port).Info("Allowing reverse port-forward request")
+	reply := struct{ Port uint32 }{port}
+	req.Reply(true, ssh.Marshal(&reply))
+}
+
+func (s *SSHSession) handleCancelTCPIPForward(req *ssh.Request) {
+	var fwdReq tcpipForwardRequest
+	if err := ssh.Unmarshal(req.Payload, &fwdReq); err != nil {
+		s.log.WithError(err).Error("Cannot parse cancel-tcpip-forward request")
+		req.Reply(false, nil)
+		return
+	}
+	s.sinksMu.Lock()
+	key := reverseForwardKey(fwdReq.BindAddr, fwdReq.BindPort)
+	if listener, ok := s.sinks[key]; ok {
+		listener.Close()
+		delete(s.sinks, key)
+	}
+	s.sinksMu.Unlock()
+	s.log.WithFields(log.Fields{
+		"bindAddr": fwdReq.BindAddr,
+		"bindPort": fwdReq.BindPort,
+	}).Info("Attacker cancelled reverse port-forward")
+	req.Reply(true, nil)
+}
+
+// setAgentFwd and getAgentFwd guard agentFwd with a mutex since it's set
+// from the per-session request-handling goroutine (handleNewSession) and
+// read from handleNewConn's goroutine when an auth-agent@openssh.com
+// channel arrives.
+func (s *SSHSession) setAgentFwd(v bool) {
+	s.agentFwdMu.Lock()
+	s.agentFwd = v
+	s.agentFwdMu.Unlock()
+}
+
+func (s *SSHSession) getAgentFwd() bool {
+	s.agentFwdMu.Lock()
+	defer s.agentFwdMu.Unlock()
+	return s.agentFwd
+}
+
+func reverseForwardKey(bindAddr string, bindPort uint32) string {
+	return fmt.Sprintf("%v:%v", bindAddr, bindPort)
+}
+
+// serveSink accepts connections on the fake listener created for a
+// reverse port-forward the attacker asked us to honor under
+// server.reverseForward "sink". Whoever connects is treated as the
+// "victim" the attacker was hoping to relay through, and is bridged to
+// the attacker over a forwarded-tcpip channel so traffic can be logged.
+func (s *SSHSession) serveSink(listener net.Listener, fwdReq tcpipForwardRequest, logger *log.Entry) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.relaySinkConn(conn, fwdReq, logger)
+	}
+}
+
+// relaySinkConn opens a forwarded-tcpip channel back to the attacker for a
+// single connection accepted on a sink listener, then bridges the two
+// halves while logging byte counts and payload samples in both directions.
+func (s *SSHSession) relaySinkConn(conn net.Conn, fwdReq tcpipForwardRequest, logger *log.Entry) {
+	defer conn.Close()
+	originHost, originPortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	originPort, _ := strconv.Atoi(originPortStr)
+	payload := forwardedTCPPayload{
+		Addr:       fwdReq.BindAddr,
+		Port:       fwdReq.BindPort,
+		OriginAddr: originHost,
+		OriginPort: uint32(originPort),
+	}
+	channel, reqs, err := s.conn.OpenChannel("forwarded-tcpip", ssh.Marshal(&payload))
+	if err != nil {
+		logger.WithError(err).Error("Cannot open forwarded-tcpip channel to attacker")
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	connLog := logger.WithFields(log.Fields{
+		"originAddr": originHost,
+		"originPort": originPort,
+	})
+	connLog.Info("Sinked reverse port-forward connection, relaying to attacker")
+
+	var toAttacker, fromAttacker int64
+	done := make(chan struct{}, 2)
+	go func() {
+		toAttacker = copyAndSamplePayload(channel, conn, connLog, "victim->attacker")
+		channel.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		fromAttacker = copyAndSamplePayload(conn, channel, connLog, "attacker->victim")
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	connLog.WithFields(log.Fields{
+		"bytesToAttacker":   toAttacker,
+		"bytesFromAttacker": fromAttacker,
+	}).Info("Sinked reverse port-forward connection closed")
+}
+
+// copyAndSamplePayload copies src to dst like io.Copy, logging the first few
+// chunks of payload seen on direction so operators can see what the
+// attacker's tooling sent through a sinked tunnel without flooding the log
+// for long-lived connections.
+func copyAndSamplePayload(dst io.Writer, src io.Reader, l *log.Entry, direction string) int64 {
+	buf := make([]byte, 4096)
+	var total int64
+	sampled := 0
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			if sampled < 3 {
+				l.WithFields(log.Fields{
+					"direction": direction,
+					"bytes":     n,
+					"payload":   string(buf[:n]),
+				}).Info("Captured payload on sinked reverse port-forward")
+				sampled++
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if rerr != nil {
+			break
+		}
+	}
+	return total
 }
 
 func (s *SSHSession) handleNewSession(newChan ssh.NewChannel) {
@@ -124,6 +367,10 @@ func (s *SSHSession) handleNewSession(newChan ssh.NewChannel) {
 				switch req.Type {
 				case "winadj@putty.projects.tartarus.org", "simple@putty.projects.tartarus.org":
 					//Do nothing here
+				case "auth-agent-req@openssh.com":
+					s.setAgentFwd(true)
+					s.log.WithField("reqType", req.Type).Info("User requesting agent forwarding")
+					req.Reply(true, nil)
 				case "pty-req":
 					// Of coz we are not going to create a PTY here as we are honeypot.
 					// We are creating a pseudo-PTY
@@ -281,7 +528,8 @@ func (s *SSHSession) handleNewConn() {
 				portMap := viper.GetStringMap("server.portRedirectionMap")
 				host = portMap[strconv.Itoa(int(treq.RemotePort))].(string)
 			case "direct":
-				host = fmt.Sprintf("%v:%v", treq.RemoteHost, treq.RemotePort)
+				s.handleSandboxedDial(newChannel, treq)
+				continue
 			}
 			if len(host) > 0 {
 				ch, req, err := newChannel.Accept()
@@ -309,6 +557,12 @@ func (s *SSHSession) handleNewConn() {
 			}
 		case "session":
 			go s.handleNewSession(newChannel)
+		case "auth-agent@openssh.com":
+			if !s.getAgentFwd() {
+				newChannel.Reject(ssh.Prohibited, "Agent forwarding was not requested")
+				continue
+			}
+			go s.handleAgentForwarding(newChannel)
 		default:
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			s.log.WithField("chanType", newChannel.ChannelType()).Infof("Unknown channel type %v", newChannel.ChannelType())
@@ -317,6 +571,55 @@ func (s *SSHSession) handleNewConn() {
 	}
 }
 
+// handleSandboxedDial resolves the attacker-requested direct-tcpip target
+// against s.sandbox instead of dialing it unconditionally, so the honeypot
+// can't be abused as an open proxy. Allowed targets are dialed for real;
+// suspicious-but-permitted ones are handed to a protocol responder that
+// fakes a banner and records whatever the attacker sends.
+func (s *SSHSession) handleSandboxedDial(newChannel ssh.NewChannel, treq tunnelRequest) {
+	logger := s.log.WithFields(log.Fields{
+		"remoteHost": treq.RemoteHost,
+		"remotePort": treq.RemotePort,
+	})
+	decision, responder := s.sandbox.Resolve(treq.RemoteHost, treq.RemotePort)
+	switch decision {
+	case netconn.DecisionReject:
+		logger.Info("Tunnel sandbox rejected direct-tcpip target")
+		newChannel.Reject(ssh.Prohibited, "Destination not reachable")
+	case netconn.DecisionSandbox:
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			logger.WithError(err).Error("Cannot accept direct-tcpip channel")
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		logger.Info("Handing direct-tcpip target to sandboxed protocol responder")
+		go func() {
+			defer ch.Close()
+			netconn.ServeResponder(ch, responder, logger)
+		}()
+	case netconn.DecisionAllow:
+		host := fmt.Sprintf("%v:%v", treq.RemoteHost, treq.RemotePort)
+		ch, reqs, err := newChannel.Accept()
+		if err != nil {
+			newChannel.Reject(ssh.ResourceShortage, "Cannot create new channel")
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		go func() {
+			logger.Info("Creating allow-listed connection to remote server")
+			conn, err := net.Dial("tcp", host)
+			if err != nil {
+				logger.WithError(err).Error("Cannot create connection")
+				ch.Close()
+				return
+			}
+			go io.Copy(conn, ch)
+			go io.Copy(ch, conn)
+		}()
+	}
+}
+
 func CreateSessionHandler(c <-chan net.Conn, sshConfig *ssh.ServerConfig, vfs afero.Fs) {
 	for conn := range c {
 		sshConfig.PasswordCallback = PasswordChallenge(viper.GetInt("server.maxTries"))
@@ -366,18 +669,7 @@ func NewServer(configPath string, hostKey []byte) (s Server) {
 
 	s = Server{
 		&ssh.ServerConfig{
-			PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				clientIP, port, _ := net.SplitHostPort(c.RemoteAddr().String())
-				log.WithFields(log.Fields{
-					"user":              c.User(),
-					"srcIP":             clientIP,
-					"port":              port,
-					"pubKeyType":        key.Type(),
-					"pubKeyFingerprint": base64.StdEncoding.EncodeToString(key.Marshal()),
-					"authMethod":        "publickey",
-				}).Info("User trying to login with key")
-				return nil, errors.New("Key rejected, revert to password login")
-			},
+			PublicKeyCallback: PublicKeyChallenge(),
 
 			ServerVersion: viper.GetString("server.ident"),
 			MaxAuthTries:  viper.GetInt("server.maxTries"),
@@ -433,6 +725,121 @@ func PasswordChallenge(tries int) func(c ssh.ConnMetadata, pass []byte) (*ssh.Pe
 	}
 }
 
+// pubKeyExtKey is the ssh.Permissions.Extensions key we stash the offered
+// public key blob under, so NewSSHSession can recover it once the
+// connection handshake finishes and attach it to the SSHSession.
+const pubKeyExtKey = "sshsyrup-pubkey-blob"
+
+// loadKeyFingerprints reads an authorized_keys-style file (one public key
+// per line) and returns the set of SHA256 fingerprints it contains, for
+// matching against offered keys under the "allowlist" and "honeytoken"
+// server.pubKeyAuth policies. An empty path, or a file that can't be read,
+// yields an empty set so the policy simply rejects every key.
+func loadKeyFingerprints(path string) map[string]bool {
+	fingerprints := map[string]bool{}
+	if path == "" {
+		return fingerprints
+	}
+	rest, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.WithError(err).WithField("path", path).Warn("Cannot read public key list file")
+		return fingerprints
+	}
+	for len(rest) > 0 {
+		key, _, _, remainder, err := ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		fingerprints[fingerprintKey(key)] = true
+		rest = remainder
+	}
+	return fingerprints
+}
+
+// PublicKeyChallenge returns a PublicKeyCallback that records the key
+// algorithm, marshaled blob, fingerprint and (when offered) certificate
+// principals/validity/critical-options of every key an attacker offers,
+// then decides whether to accept it per server.pubKeyAuth:
+//
+//	reject       - always fall back to password auth (default)
+//	acceptAll    - accept every offered key
+//	acceptAfterN - accept once the same connection has offered
+//	               server.pubKeyAcceptAfterTries keys
+//	allowlist    - accept only keys whose fingerprint appears in the
+//	               authorized_keys-style file at server.pubKeyAllowlistFile
+//	honeytoken   - accept only keys whose fingerprint appears in the
+//	               authorized_keys-style file at server.pubKeyHoneytokenFile,
+//	               logging an extra warning since a match means one of our
+//	               planted canary keys is being used somewhere it shouldn't be
+//
+// Note the ssh package itself still verifies the attacker actually holds
+// the private key before this callback's success is honoured - it calls
+// back once per offered key, before any signature is checked, and reuses
+// that result for the signed request, so a returned nil error here records
+// an "offered" key, not a "proved possession" one.
+func PublicKeyChallenge() func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	var triesMu sync.Mutex
+	triesByConn := map[string]int{}
+	allowlist := loadKeyFingerprints(viper.GetString("server.pubKeyAllowlistFile"))
+	honeytokens := loadKeyFingerprints(viper.GetString("server.pubKeyHoneytokenFile"))
+	return func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		clientIP, port, _ := net.SplitHostPort(c.RemoteAddr().String())
+		fields := log.Fields{
+			"user":              c.User(),
+			"srcIP":             clientIP,
+			"port":              port,
+			"pubKeyType":        key.Type(),
+			"pubKeyFingerprint": fingerprintKey(key),
+			"authMethod":        "publickey",
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			fields["certKeyId"] = cert.KeyId
+			fields["certPrincipals"] = strings.Join(cert.ValidPrincipals, ",")
+			fields["certValidAfter"] = cert.ValidAfter
+			fields["certValidBefore"] = cert.ValidBefore
+			fields["certCriticalOptions"] = fmt.Sprintf("%v", cert.CriticalOptions)
+		}
+		log.WithFields(fields).Info("User trying to login with key")
+
+		perm := &ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-agent-forwarding": "yes",
+				pubKeyExtKey:              base64.StdEncoding.EncodeToString(key.Marshal()),
+			},
+		}
+		switch viper.GetString("server.pubKeyAuth") {
+		case "acceptAll":
+			return perm, nil
+		case "allowlist":
+			if allowlist[fingerprintKey(key)] {
+				return perm, nil
+			}
+			return nil, errors.New("key rejected, not on allowlist")
+		case "honeytoken":
+			if honeytokens[fingerprintKey(key)] {
+				log.WithFields(fields).Warn("Attacker offered a known honeytoken key")
+				return perm, nil
+			}
+			return nil, errors.New("key rejected, revert to password login")
+		case "acceptAfterN":
+			connID := string(c.SessionID())
+			triesMu.Lock()
+			triesByConn[connID]++
+			tries := triesByConn[connID]
+			if tries >= viper.GetInt("server.pubKeyAcceptAfterTries") {
+				delete(triesByConn, connID)
+			}
+			triesMu.Unlock()
+			if tries >= viper.GetInt("server.pubKeyAcceptAfterTries") {
+				return perm, nil
+			}
+			return nil, errors.New("key rejected, try another")
+		default:
+			return nil, errors.New("Key rejected, revert to password login")
+		}
+	}
+}
+
 func (sc Server) ListenAndServe() {
 	connChan := make(chan net.Conn)
 	// Create pool of workers to handle connections
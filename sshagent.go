@@ -0,0 +1,154 @@
+package sshsyrup
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH agent protocol message numbers, see
+// https://tools.ietf.org/html/draft-miller-ssh-agent-04
+const (
+	agentFailure             = 5
+	agentSuccess             = 6
+	agentRequestIdentities   = 11
+	agentIdentitiesAnswer    = 12
+	agentSignRequest         = 13
+	agentSignResponse        = 14
+	agentAddSmartcardKey     = 20
+	agentRemoveSmartcardKey  = 21
+	agentAddIdentity         = 17
+	agentRemoveIdentity      = 18
+	agentRemoveAllIdentities = 19
+	agentAddIDConstrained    = 25
+
+	// maxAgentMessageLen bounds the length-prefixed agent message size we'll
+	// allocate for, mirroring the cap real SSH agent implementations place on
+	// the wire. Without it an attacker-controlled 4-byte length lets a single
+	// forwarded message request up to ~4GiB, OOM-killing the honeypot.
+	maxAgentMessageLen = 256 * 1024
+)
+
+// handleAgentForwarding accepts the reverse auth-agent@openssh.com channel the
+// client opens after a successful auth-agent-req@openssh.com on the session
+// channel, and speaks just enough of the agent wire protocol to enumerate
+// what the attacker's tools ask of it. Every key the attacker tries to add
+// or sign with is logged against the session so it can be correlated with
+// other incidents later.
+func (s *SSHSession) handleAgentForwarding(newChan ssh.NewChannel) {
+	channel, requests, err := newChan.Accept()
+	if err != nil {
+		s.log.WithError(err).Error("Could not accept auth-agent channel")
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	agentLog := s.log.WithField("module", "sshagent")
+	for {
+		msg, err := readAgentMessage(channel)
+		if err != nil {
+			if err != io.EOF {
+				agentLog.WithError(err).Debug("Agent channel closed")
+			}
+			return
+		}
+		if len(msg) == 0 {
+			writeAgentMessage(channel, []byte{agentFailure})
+			continue
+		}
+		switch msg[0] {
+		case agentRequestIdentities:
+			agentLog.Info("Attacker's tools enumerated forwarded agent identities")
+			// We never hold real keys, so answer with an empty identity list
+			// rather than a flat failure - real agents do the same when empty.
+			writeAgentMessage(channel, append([]byte{agentIdentitiesAnswer}, 0, 0, 0, 0))
+		case agentSignRequest:
+			fields := log.Fields{}
+			if blob, _, ok := parseAgentString(msg[1:]); ok {
+				fields["keyBlob"] = base64.StdEncoding.EncodeToString([]byte(blob))
+				if key, err := ssh.ParsePublicKey([]byte(blob)); err == nil {
+					fields["keyType"] = key.Type()
+					fields["keyFingerprint"] = fingerprintKey(key)
+				}
+			}
+			agentLog.WithFields(fields).Info("Attacker requested a signature from the forwarded agent")
+			writeAgentMessage(channel, []byte{agentFailure})
+		case agentAddIdentity, agentAddIDConstrained:
+			logAddedIdentity(agentLog, msg[1:])
+			writeAgentMessage(channel, []byte{agentSuccess})
+		case agentAddSmartcardKey:
+			agentLog.Info("Attacker attempted to add a smartcard key to the forwarded agent")
+			writeAgentMessage(channel, []byte{agentSuccess})
+		case agentRemoveIdentity, agentRemoveAllIdentities, agentRemoveSmartcardKey:
+			writeAgentMessage(channel, []byte{agentSuccess})
+		default:
+			agentLog.WithField("msgType", msg[0]).Info("Unknown agent message type")
+			writeAgentMessage(channel, []byte{agentFailure})
+		}
+	}
+}
+
+// readAgentMessage reads one length-prefixed SSH agent protocol message.
+func readAgentMessage(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	if length > maxAgentMessageLen {
+		return nil, fmt.Errorf("agent message length %d exceeds limit of %d bytes", length, maxAgentMessageLen)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func writeAgentMessage(w io.Writer, msg []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(msg)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// logAddedIdentity parses as much of an SSH_AGENTC_ADD_IDENTITY payload as
+// needed to record the key type and the private key material the attacker
+// handed over, without attempting a full private key unmarshal.
+func logAddedIdentity(agentLog *log.Entry, payload []byte) {
+	keyType, _, ok := parseAgentString(payload)
+	if !ok {
+		agentLog.Info("Attacker added an identity to the forwarded agent (malformed payload)")
+		return
+	}
+	agentLog.WithFields(log.Fields{
+		"keyType":   keyType,
+		"keyBlob":   base64.StdEncoding.EncodeToString(payload),
+		"byteCount": len(payload),
+	}).Warn("Attacker inserted a private key into the forwarded agent")
+}
+
+// parseAgentString reads one SSH wire-format string (uint32 length prefix
+// plus payload) from the front of buf.
+func parseAgentString(buf []byte) (string, []byte, bool) {
+	if len(buf) < 4 {
+		return "", nil, false
+	}
+	length := binary.BigEndian.Uint32(buf[:4])
+	if uint32(len(buf)-4) < length {
+		return "", nil, false
+	}
+	return string(buf[4 : 4+length]), buf[4+length:], true
+}
+
+func fingerprintKey(key ssh.PublicKey) string {
+	return fmt.Sprintf("SHA256:%v", ssh.FingerprintSHA256(key))
+}